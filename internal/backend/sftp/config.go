@@ -0,0 +1,109 @@
+package sftp
+
+import (
+	"path"
+	"strings"
+
+	"github.com/restic/restic/internal/errors"
+)
+
+// Config collects all information required to connect to an sftp server.
+type Config struct {
+	User, Host, Port, Path string
+
+	Layout string `option:"layout" help:"use this backend directory layout (default: auto-detect)"`
+
+	Command string `option:"command" help:"specify command to create sftp connection"`
+	Args    string `option:"args" help:"specify arguments to use in place of those given by default (only create connection)"`
+
+	// Transport selects how restic talks to the sftp server: "exec" (the
+	// default) runs the system ssh binary and speaks sftp over its stdio,
+	// "native" dials the server directly using golang.org/x/crypto/ssh
+	// without spawning a subprocess.
+	Transport string `option:"transport" help:"ssh transport to use, 'exec' or 'native' (default: exec)"`
+
+	Connections uint `option:"connections" help:"set a limit for the number of concurrent connections (default: 5)"`
+
+	// Warmup selects the strategy used to warm up cold files before
+	// restore/prune read them: "none" does nothing, "touch" opens (and
+	// closes) each file to trigger the remote OS page cache, "prefetch"
+	// additionally reads the first bytes to trigger HSM/tape stage-in.
+	Warmup string `option:"warmup" help:"sftp warmup strategy, 'none', 'touch' or 'prefetch' (default: none)"`
+}
+
+// NewConfig returns a new Config with the default values filled in.
+func NewConfig() Config {
+	return Config{
+		Connections: 5,
+		Transport:   "exec",
+		Warmup:      "none",
+	}
+}
+
+func parsePath(s string) (host, dir string) {
+	data := strings.SplitN(s, ":", 2)
+	if len(data) < 2 {
+		host = s
+		dir = "/"
+		return host, dir
+	}
+
+	host, dir = data[0], data[1]
+	dir = path.Clean(dir)
+	return host, dir
+}
+
+// ParseConfig parses the string s and extracts the sftp config. The
+// supported configuration formats are sftp://user@host/path and
+// sftp:user@host:path. The directory will be path.Clean()ed.
+func ParseConfig(s string) (interface{}, error) {
+	var user, host, port, dir string
+
+	switch {
+	case strings.HasPrefix(s, "sftp://"):
+		s = s[len("sftp://"):]
+
+		data := strings.SplitN(s, "@", 2)
+		if len(data) > 1 {
+			user = data[0]
+			s = data[1]
+		}
+
+		data = strings.SplitN(s, "/", 2)
+		if len(data) != 2 {
+			return nil, errors.New("sftp: invalid format, hostname or path not found")
+		}
+		host, dir = data[0], data[1]
+
+		data = strings.SplitN(host, ":", 2)
+		if len(data) == 2 {
+			host, port = data[0], data[1]
+		}
+
+		if dir == "" {
+			return nil, errors.New("sftp: invalid format, directory not found")
+		}
+
+		dir = path.Clean(dir)
+
+	case strings.HasPrefix(s, "sftp:"):
+		s = s[len("sftp:"):]
+
+		data := strings.SplitN(s, "@", 2)
+		if len(data) > 1 {
+			user = data[0]
+			s = data[1]
+		}
+		host, dir = parsePath(s)
+
+	default:
+		return nil, errors.New("sftp: invalid format")
+	}
+
+	cfg := NewConfig()
+	cfg.User = user
+	cfg.Host = host
+	cfg.Port = port
+	cfg.Path = dir
+	return cfg, nil
+}
@@ -0,0 +1,68 @@
+package sftp
+
+import (
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// sftpFile is the subset of *sftp.File's methods the backend needs. It lets
+// sftpFS implementations hand back something other than a concrete
+// *sftp.File, e.g. an in-memory file used in tests.
+type sftpFile interface {
+	io.ReadWriteCloser
+	io.Seeker
+
+	Name() string
+	Chmod(mode os.FileMode) error
+	ReadFromWithConcurrency(r io.Reader, concurrency int) (int64, error)
+}
+
+// fsWalker is the subset of *sftp.Walker's methods the backend needs to
+// implement List.
+type fsWalker interface {
+	Step() bool
+	Err() error
+	Path() string
+	Stat() os.FileInfo
+	SkipDir()
+}
+
+// sftpFS is the subset of *sftp.Client's methods the backend operates on.
+// It is satisfied by *sftp.Client (via sftpClientFS below) and, for tests,
+// by the in-memory filesystem in the memfs package.
+type sftpFS interface {
+	Open(path string) (sftpFile, error)
+	OpenFile(path string, flags int) (sftpFile, error)
+	Stat(path string) (os.FileInfo, error)
+	Lstat(path string) (os.FileInfo, error)
+	Mkdir(path string) error
+	MkdirAll(path string) error
+	Remove(path string) error
+	RemoveDirectory(path string) error
+	Rename(oldname, newname string) error
+	PosixRename(oldname, newname string) error
+	ReadDir(path string) ([]os.FileInfo, error)
+	Walk(root string) fsWalker
+	HasExtension(name string) (string, bool)
+	StatVFS(path string) (*sftp.StatVFS, error)
+	Close() error
+}
+
+// sftpClientFS adapts a *sftp.Client to the sftpFS interface.
+type sftpClientFS struct {
+	*sftp.Client
+}
+
+func (c sftpClientFS) Open(path string) (sftpFile, error) {
+	return c.Client.Open(path)
+}
+
+func (c sftpClientFS) OpenFile(path string, flags int) (sftpFile, error) {
+	return c.Client.OpenFile(path, flags)
+}
+
+func (c sftpClientFS) Walk(root string) fsWalker {
+	return c.Client.Walk(root)
+}
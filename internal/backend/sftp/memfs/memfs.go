@@ -0,0 +1,465 @@
+// Package memfs provides a small in-memory filesystem, modeled after
+// afero's MemMapFs, that implements enough of the sftp client API for the
+// sftp backend to be unit-tested without spawning ssh or an SFTP server.
+package memfs
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+type node struct {
+	name     string
+	isDir    bool
+	mode     os.FileMode
+	modTime  time.Time
+	data     []byte
+	children map[string]*node
+}
+
+func newDir(name string) *node {
+	return &node{name: name, isDir: true, mode: os.ModeDir | 0755, modTime: time.Now(), children: map[string]*node{}}
+}
+
+// FS is an in-memory filesystem satisfying the subset of the sftp client
+// API the sftp backend needs.
+type FS struct {
+	mu   sync.Mutex
+	root *node
+
+	// StatVFSResult, if non-nil, is returned by StatVFS in place of a default
+	// result describing a filesystem with plenty of free space. StatVFSErr,
+	// if non-nil, is returned instead of either. Tests can use them to
+	// exercise the checkNoSpace code path.
+	StatVFSResult *sftp.StatVFS
+	StatVFSErr    error
+
+	// PosixRenameSupported controls whether HasExtension reports support
+	// for posix-rename@openssh.com.
+	PosixRenameSupported bool
+
+	// StatVFSSupported controls whether HasExtension reports support for
+	// statvfs@openssh.com.
+	StatVFSSupported bool
+}
+
+// New returns an empty in-memory filesystem.
+func New() *FS {
+	return &FS{root: newDir("/"), PosixRenameSupported: true}
+}
+
+func clean(p string) string {
+	return path.Clean("/" + p)
+}
+
+func split(p string) (dir, base string) {
+	p = clean(p)
+	dir, base = path.Split(p)
+	return clean(dir), base
+}
+
+// lookup returns the node at p, holding fs.mu.
+func (fs *FS) lookup(p string) (*node, error) {
+	p = clean(p)
+	if p == "/" {
+		return fs.root, nil
+	}
+
+	cur := fs.root
+	for _, part := range splitParts(p) {
+		if !cur.isDir {
+			return nil, os.ErrNotExist
+		}
+		next, ok := cur.children[part]
+		if !ok {
+			return nil, os.ErrNotExist
+		}
+		cur = next
+	}
+	return cur, nil
+}
+
+func splitParts(p string) []string {
+	p = clean(p)
+	if p == "/" {
+		return nil
+	}
+	var parts []string
+	for _, part := range pathSplit(p[1:]) {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return parts
+}
+
+func pathSplit(p string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(p); i++ {
+		if p[i] == '/' {
+			parts = append(parts, p[start:i])
+			start = i + 1
+		}
+	}
+	parts = append(parts, p[start:])
+	return parts
+}
+
+// File is an open handle to a node's data, implementing enough of
+// *sftp.File's API to stand in for it in tests.
+type File struct {
+	fs    *FS
+	n     *node
+	name  string
+	pos   int64
+	flags int
+}
+
+func (f *File) Name() string { return f.name }
+
+func (f *File) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	if f.pos >= int64(len(f.n.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.n.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+
+	end := f.pos + int64(len(p))
+	if end > int64(len(f.n.data)) {
+		grown := make([]byte, end)
+		copy(grown, f.n.data)
+		f.n.data = grown
+	}
+	copy(f.n.data[f.pos:end], p)
+	f.pos = end
+	return len(p), nil
+}
+
+// ReadFromWithConcurrency mirrors *sftp.File's optimized upload method; the
+// in-memory filesystem has no concurrency to exploit, so this just copies.
+func (f *File) ReadFromWithConcurrency(r io.Reader, _ int) (int64, error) {
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, r)
+	if err != nil {
+		return n, err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (f *File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+		f.pos = offset
+	case io.SeekCurrent:
+		f.pos += offset
+	case io.SeekEnd:
+		f.fs.mu.Lock()
+		f.pos = int64(len(f.n.data)) + offset
+		f.fs.mu.Unlock()
+	}
+	return f.pos, nil
+}
+
+func (f *File) Chmod(mode os.FileMode) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.n.mode = mode
+	return nil
+}
+
+func (f *File) Close() error { return nil }
+
+// Open opens path for reading.
+func (fs *FS) Open(p string) (*File, error) {
+	return fs.OpenFile(p, os.O_RDONLY)
+}
+
+// OpenFile opens path according to flags, creating it (and failing if it
+// already exists) when O_CREATE|O_EXCL is set, matching the subset of
+// behavior the sftp backend relies on.
+func (fs *FS) OpenFile(p string, flags int) (*File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, base := split(p)
+	parent, err := fs.lookup(dir)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+	}
+	if !parent.isDir {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrInvalid}
+	}
+
+	n, ok := parent.children[base]
+	if ok && flags&os.O_CREATE != 0 && flags&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrExist}
+	}
+	if !ok {
+		if flags&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: p, Err: os.ErrNotExist}
+		}
+		n = &node{name: base, mode: 0644, modTime: time.Now()}
+		parent.children[base] = n
+	}
+
+	return &File{fs: fs, n: n, name: p, flags: flags}, nil
+}
+
+// Stat and Lstat are identical: memfs has no symlinks.
+func (fs *FS) Stat(p string) (os.FileInfo, error)  { return fs.stat(p) }
+func (fs *FS) Lstat(p string) (os.FileInfo, error) { return fs.stat(p) }
+
+func (fs *FS) stat(p string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.lookup(p)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: p, Err: os.ErrNotExist}
+	}
+	return fileInfo{n}, nil
+}
+
+// Mkdir creates path; its parent must already exist.
+func (fs *FS) Mkdir(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, base := split(p)
+	parent, err := fs.lookup(dir)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrNotExist}
+	}
+	if _, ok := parent.children[base]; ok {
+		return &os.PathError{Op: "mkdir", Path: p, Err: os.ErrExist}
+	}
+	parent.children[base] = newDir(base)
+	return nil
+}
+
+// MkdirAll creates path and any missing parents.
+func (fs *FS) MkdirAll(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	cur := fs.root
+	for _, part := range splitParts(p) {
+		next, ok := cur.children[part]
+		if !ok {
+			next = newDir(part)
+			cur.children[part] = next
+		}
+		if !next.isDir {
+			return &os.PathError{Op: "mkdirall", Path: p, Err: os.ErrInvalid}
+		}
+		cur = next
+	}
+	return nil
+}
+
+// Remove removes a single file or empty directory.
+func (fs *FS) Remove(p string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	dir, base := split(p)
+	parent, err := fs.lookup(dir)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	n, ok := parent.children[base]
+	if !ok {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrNotExist}
+	}
+	if n.isDir && len(n.children) > 0 {
+		return &os.PathError{Op: "remove", Path: p, Err: os.ErrInvalid}
+	}
+	delete(parent.children, base)
+	return nil
+}
+
+// RemoveDirectory removes an empty directory.
+func (fs *FS) RemoveDirectory(p string) error {
+	return fs.Remove(p)
+}
+
+// Rename renames oldname to newname, overwriting newname if it exists,
+// mirroring OpenSSH's non-atomic rename extension behavior closely enough
+// for tests.
+func (fs *FS) Rename(oldname, newname string) error {
+	return fs.rename(oldname, newname)
+}
+
+// PosixRename behaves like Rename; memfs has no way to observe atomicity,
+// but tests can flip FS.PosixRenameSupported to check HasExtension branches.
+func (fs *FS) PosixRename(oldname, newname string) error {
+	return fs.rename(oldname, newname)
+}
+
+func (fs *FS) rename(oldname, newname string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	oldDir, oldBase := split(oldname)
+	oldParent, err := fs.lookup(oldDir)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+	n, ok := oldParent.children[oldBase]
+	if !ok {
+		return &os.PathError{Op: "rename", Path: oldname, Err: os.ErrNotExist}
+	}
+
+	newDir, newBase := split(newname)
+	newParent, err := fs.lookup(newDir)
+	if err != nil {
+		return &os.PathError{Op: "rename", Path: newname, Err: os.ErrNotExist}
+	}
+
+	delete(oldParent.children, oldBase)
+	n.name = newBase
+	newParent.children[newBase] = n
+	return nil
+}
+
+// ReadDir returns the entries of path, sorted by name.
+func (fs *FS) ReadDir(p string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.lookup(p)
+	if err != nil || !n.isDir {
+		return nil, &os.PathError{Op: "readdir", Path: p, Err: os.ErrNotExist}
+	}
+
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		entries = append(entries, fileInfo{n.children[name]})
+	}
+	return entries, nil
+}
+
+// HasExtension reports whether the in-memory filesystem "supports" the
+// named sftp protocol extension, controlled by the FS.*Supported fields.
+func (fs *FS) HasExtension(name string) (string, bool) {
+	switch name {
+	case "posix-rename@openssh.com":
+		return "1", fs.PosixRenameSupported
+	case "statvfs@openssh.com":
+		return "2", fs.StatVFSSupported
+	default:
+		return "", false
+	}
+}
+
+// StatVFS returns fs.StatVFSResult/StatVFSErr, letting tests fake out
+// checkNoSpace without a real filesystem.
+func (fs *FS) StatVFS(_ string) (*sftp.StatVFS, error) {
+	if fs.StatVFSErr != nil {
+		return nil, fs.StatVFSErr
+	}
+	if fs.StatVFSResult != nil {
+		return fs.StatVFSResult, nil
+	}
+	return &sftp.StatVFS{Bsize: 4096, Frsize: 4096, Blocks: 1 << 20, Bavail: 1 << 20, Favail: 1 << 20}, nil
+}
+
+// Close is a no-op; the in-memory filesystem has no connection to tear
+// down.
+func (fs *FS) Close() error { return nil }
+
+// Walker walks an in-memory directory tree in the same pre-order,
+// skip-dir-aware style as *sftp.Walker.
+type Walker struct {
+	stack []walkEntry
+	cur   walkEntry
+	err   error
+	skip  bool
+}
+
+type walkEntry struct {
+	path string
+	n    *node
+}
+
+// Walk returns a Walker rooted at root.
+func (fs *FS) Walk(root string) *Walker {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	n, err := fs.lookup(root)
+	if err != nil {
+		return &Walker{err: os.ErrNotExist}
+	}
+	return &Walker{stack: []walkEntry{{path: clean(root), n: n}}}
+}
+
+func (w *Walker) Step() bool {
+	if w.err != nil && len(w.stack) == 0 {
+		return false
+	}
+
+	if w.skip {
+		w.skip = false
+	} else if w.cur.n != nil && w.cur.n.isDir {
+		names := make([]string, 0, len(w.cur.n.children))
+		for name := range w.cur.n.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i := len(names) - 1; i >= 0; i-- {
+			child := w.cur.n.children[names[i]]
+			w.stack = append(w.stack, walkEntry{path: path.Join(w.cur.path, names[i]), n: child})
+		}
+	}
+
+	if len(w.stack) == 0 {
+		return false
+	}
+
+	w.cur = w.stack[len(w.stack)-1]
+	w.stack = w.stack[:len(w.stack)-1]
+	return true
+}
+
+func (w *Walker) Err() error        { return w.err }
+func (w *Walker) Path() string      { return w.cur.path }
+func (w *Walker) Stat() os.FileInfo { return fileInfo{w.cur.n} }
+func (w *Walker) SkipDir()          { w.skip = true }
+
+type fileInfo struct {
+	n *node
+}
+
+func (fi fileInfo) Name() string       { return fi.n.name }
+func (fi fileInfo) Size() int64        { return int64(len(fi.n.data)) }
+func (fi fileInfo) Mode() os.FileMode  { return fi.n.mode }
+func (fi fileInfo) ModTime() time.Time { return fi.n.modTime }
+func (fi fileInfo) IsDir() bool        { return fi.n.isDir }
+func (fi fileInfo) Sys() interface{}   { return nil }
@@ -0,0 +1,193 @@
+package sftp
+
+import (
+	"context"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/restic/restic/internal/debug"
+	"github.com/restic/restic/internal/errors"
+
+	"github.com/cenkalti/backoff/v4"
+	"golang.org/x/crypto/ssh"
+)
+
+// session is a single sftpFS together with whatever is needed to tear it
+// down again: either the ssh subprocess backing it (Config.Transport ==
+// "exec") or the ssh channel it was opened on (Config.Transport ==
+// "native"). For native transport, the underlying *ssh.Client is shared
+// across every session in the pool and is closed by the pool itself, not
+// by the session.
+type session struct {
+	client sftpFS
+
+	cmd    *exec.Cmd
+	result <-chan error
+
+	sshSession *ssh.Session
+}
+
+// newSessionDialer returns a function that dials a fresh session for cfg,
+// plus the shared *ssh.Client sessions are dialed on for native transport
+// (nil for exec transport, where each session is an independent
+// subprocess). For native transport, the SSH connection is dialed once
+// here; every call to the returned function then only opens a new channel
+// on it, so a pool of N sessions costs one SSH connection and handshake,
+// not N.
+func newSessionDialer(cfg Config) (dial func() (*session, error), sshClient *ssh.Client, err error) {
+	if cfg.Transport != "native" {
+		return func() (*session, error) {
+			return dialSessionExec(cfg)
+		}, nil, nil
+	}
+
+	sshClient, err = dialSSHClient(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return func() (*session, error) {
+		return newNativeSession(sshClient)
+	}, sshClient, nil
+}
+
+// clientError returns an error if the session's underlying connection has
+// exited. Otherwise, nil is returned immediately.
+func (s *session) clientError() error {
+	select {
+	case err := <-s.result:
+		debug.Log("session has exited with err %v", err)
+		return backoff.Permanent(err)
+	default:
+	}
+
+	return nil
+}
+
+func (s *session) Close() error {
+	err := errors.Wrap(s.client.Close(), "Close")
+	debug.Log("session Close returned error %v", err)
+
+	select {
+	case err := <-s.result:
+		return err
+	case <-time.After(closeTimeout):
+	}
+
+	if s.cmd != nil {
+		if err := s.cmd.Process.Kill(); err != nil {
+			return err
+		}
+	} else if s.sshSession != nil {
+		if err := s.sshSession.Close(); err != nil {
+			return err
+		}
+	}
+
+	// get the error, but ignore it
+	<-s.result
+	return nil
+}
+
+// sessionPool hands out a fixed number of independent sftp sessions so that
+// Save/Load/Stat/List calls issued concurrently don't serialize against a
+// single SFTP channel. Sessions are either separate SSH channels over one
+// SSH connection (native transport) or separate "ssh -s sftp" subprocesses
+// (exec transport).
+type sessionPool struct {
+	cfg      Config
+	sessions chan *session
+	dial     func() (*session, error)
+
+	// sshClient is the single SSH connection shared by every session in
+	// the pool for native transport, closed once by Close; nil for exec
+	// transport, where each session owns its own subprocess.
+	sshClient *ssh.Client
+
+	// wg tracks sessions currently checked out via get, so that Close can
+	// wait for them to be returned via put before closing the channel they
+	// live in.
+	wg sync.WaitGroup
+}
+
+// newSessionPool dials n sessions and returns a pool serving them. n is
+// clamped to at least 1: a pool with no sessions would make every get call
+// block forever.
+func newSessionPool(cfg Config, n uint) (*sessionPool, error) {
+	if n == 0 {
+		n = 1
+	}
+
+	dial, sshClient, err := newSessionDialer(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sessionPool{cfg: cfg, sessions: make(chan *session, n), dial: dial, sshClient: sshClient}
+
+	for i := uint(0); i < n; i++ {
+		s, err := dial()
+		if err != nil {
+			_ = p.Close()
+			return nil, err
+		}
+		p.sessions <- s
+	}
+
+	return p, nil
+}
+
+// get checks out an idle session, blocking until one becomes available or
+// ctx is cancelled. A session whose connection has died is replaced with a
+// freshly dialed one before being handed out.
+func (p *sessionPool) get(ctx context.Context) (*session, error) {
+	select {
+	case s := <-p.sessions:
+		if err := s.clientError(); err != nil {
+			debug.Log("sftp: evicting dead session: %v", err)
+			_ = s.Close()
+			fresh, err := p.dial()
+			if err != nil {
+				// keep the slot: the next get sees the dead session again
+				// and retries the dial
+				p.sessions <- s
+				return nil, err
+			}
+			s = fresh
+		}
+		p.wg.Add(1)
+		return s, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// put returns a session to the pool.
+func (p *sessionPool) put(s *session) {
+	p.sessions <- s
+	p.wg.Done()
+}
+
+// Close waits for all checked-out sessions to be returned via put, then
+// closes all sessions in the pool and, for native transport, the shared
+// ssh.Client underlying them.
+func (p *sessionPool) Close() error {
+	p.wg.Wait()
+	close(p.sessions)
+
+	var firstErr error
+	for s := range p.sessions {
+		if err := s.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if p.sshClient != nil {
+		if err := p.sshClient.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"sync"
 	"time"
 
 	"github.com/restic/restic/internal/backend"
@@ -27,16 +28,21 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-// SFTP is a backend in a directory accessed via SFTP.
+// SFTP is a backend in a directory accessed via SFTP. Operations are spread
+// across a pool of independent sftp sessions so that concurrent Save/Load
+// calls don't serialize against a single SFTP channel.
 type SFTP struct {
-	c *sftp.Client
-	p string
-
-	cmd    *exec.Cmd
-	result <-chan error
+	pool *sessionPool
+	p    string
 
 	posixRename bool
 
+	// warmupMu guards warmups, which tracks in-flight Warmup batches by
+	// handle so that WarmupWait can wait for the specific batch it was
+	// given, even if another Warmup call has started in the meantime.
+	warmupMu sync.Mutex
+	warmups  map[backend.Handle]*warmupResult
+
 	layout.Layout
 	Config
 	util.Modes
@@ -50,7 +56,7 @@ func NewFactory() location.Factory {
 	return location.NewLimitedBackendFactory("sftp", ParseConfig, location.NoPassword, limiter.WrapBackendConstructor(Create), limiter.WrapBackendConstructor(Open))
 }
 
-func startClient(cfg Config) (*SFTP, error) {
+func dialSessionExec(cfg Config) (*session, error) {
 	program, args, err := buildSSHCommand(cfg)
 	if err != nil {
 		return nil, err
@@ -118,73 +124,76 @@ func startClient(cfg Config) (*SFTP, error) {
 		return nil, errors.Wrap(err, "bg")
 	}
 
-	_, posixRename := client.HasExtension("posix-rename@openssh.com")
-	return &SFTP{
-		c:           client,
-		cmd:         cmd,
-		result:      ch,
-		posixRename: posixRename,
-		Layout:      layout.NewDefaultLayout(cfg.Path, path.Join),
+	return &session{
+		client: sftpClientFS{client},
+		cmd:    cmd,
+		result: ch,
 	}, nil
 }
 
-// clientError returns an error if the client has exited. Otherwise, nil is
-// returned immediately.
-func (r *SFTP) clientError() error {
-	select {
-	case err := <-r.result:
-		debug.Log("client has exited with err %v", err)
-		return backoff.Permanent(err)
-	default:
-	}
-
-	return nil
-}
-
 // Open opens an sftp backend as described by the config by running
 // "ssh" with the appropriate arguments (or cfg.Command, if set).
 func Open(_ context.Context, cfg Config) (*SFTP, error) {
 	debug.Log("open backend with config %#v", cfg)
 
-	sftp, err := startClient(cfg)
+	pool, err := newSessionPool(cfg, cfg.Connections)
 	if err != nil {
-		debug.Log("unable to start program: %v", err)
+		debug.Log("unable to start pool: %v", err)
 		return nil, err
 	}
 
-	return open(sftp, cfg)
+	return open(pool, cfg)
 }
 
-func open(sftp *SFTP, cfg Config) (*SFTP, error) {
-	fi, err := sftp.c.Stat(sftp.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+func open(pool *sessionPool, cfg Config) (*SFTP, error) {
+	r := &SFTP{
+		pool:   pool,
+		p:      cfg.Path,
+		Config: cfg,
+		Layout: layout.NewDefaultLayout(cfg.Path, path.Join),
+	}
+
+	s, err := pool.get(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	_, r.posixRename = s.client.HasExtension("posix-rename@openssh.com")
+	fi, err := s.client.Stat(r.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+	pool.put(s)
+
 	m := util.DeriveModesFromFileInfo(fi, err)
 	debug.Log("using (%03O file, %03O dir) permissions", m.File, m.Dir)
+	r.Modes = m
 
-	sftp.Config = cfg
-	sftp.p = cfg.Path
-	sftp.Modes = m
-	return sftp, nil
+	return r, nil
 }
 
 func (r *SFTP) mkdirAllDataSubdirs(ctx context.Context, nconn uint) error {
 	// Run multiple MkdirAll calls concurrently. These involve multiple
 	// round-trips and we do a lot of them, so this whole operation can be slow
-	// on high-latency links.
-	g, _ := errgroup.WithContext(ctx)
-	// Use errgroup's built-in semaphore, because r.sem is not initialized yet.
+	// on high-latency links. Each goroutine checks out its own session from
+	// the pool so that the calls don't serialize against a single SFTP
+	// channel.
+	g, ctx := errgroup.WithContext(ctx)
 	g.SetLimit(int(nconn))
 
 	for _, d := range r.Paths() {
 		d := d
 		g.Go(func() error {
+			s, err := r.pool.get(ctx)
+			if err != nil {
+				return err
+			}
+			defer r.pool.put(s)
+
 			// First try Mkdir. For most directories in Paths, this takes one
 			// round trip, not counting duplicate parent creations causes by
 			// concurrency. MkdirAll first does Stat, then recursive MkdirAll
 			// on the parent, so calls typically take three round trips.
-			if err := r.c.Mkdir(d); err == nil {
+			if err := s.client.Mkdir(d); err == nil {
 				return nil
 			}
-			return errors.Wrapf(r.c.MkdirAll(d), "MkdirAll %v", d)
+			return errors.Wrapf(s.client.MkdirAll(d), "MkdirAll %v", d)
 		})
 	}
 
@@ -241,27 +250,36 @@ func buildSSHCommand(cfg Config) (cmd string, args []string, err error) {
 // Create creates an sftp backend as described by the config by running "ssh"
 // with the appropriate arguments (or cfg.Command, if set).
 func Create(ctx context.Context, cfg Config) (*SFTP, error) {
-	sftp, err := startClient(cfg)
+	pool, err := newSessionPool(cfg, cfg.Connections)
 	if err != nil {
-		debug.Log("unable to start program: %v", err)
+		debug.Log("unable to start pool: %v", err)
 		return nil, err
 	}
 
-	sftp.Modes = util.DefaultModes
+	l := layout.NewDefaultLayout(cfg.Path, path.Join)
 
+	s, err := pool.get(ctx)
+	if err != nil {
+		_ = pool.Close()
+		return nil, err
+	}
 	// test if config file already exists
-	_, err = sftp.c.Lstat(sftp.Layout.Filename(backend.Handle{Type: backend.ConfigFile}))
+	_, err = s.client.Lstat(l.Filename(backend.Handle{Type: backend.ConfigFile}))
+	pool.put(s)
 	if err == nil {
+		_ = pool.Close()
 		return nil, errors.New("config file already exists")
 	}
 
+	r := &SFTP{pool: pool, p: cfg.Path, Config: cfg, Layout: l, Modes: util.DefaultModes}
+
 	// create paths for data and refs
-	if err = sftp.mkdirAllDataSubdirs(ctx, cfg.Connections); err != nil {
+	if err = r.mkdirAllDataSubdirs(ctx, cfg.Connections); err != nil {
 		return nil, err
 	}
 
-	// repurpose existing connection
-	return open(sftp, cfg)
+	// repurpose existing connection pool
+	return open(pool, cfg)
 }
 
 func (r *SFTP) Properties() backend.Properties {
@@ -288,26 +306,28 @@ func tempSuffix() string {
 }
 
 // Save stores data in the backend at the handle.
-func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader) error {
-	if err := r.clientError(); err != nil {
+func (r *SFTP) Save(ctx context.Context, h backend.Handle, rd backend.RewindReader) error {
+	s, err := r.pool.get(ctx)
+	if err != nil {
 		return err
 	}
+	defer r.pool.put(s)
 
 	filename := r.Filename(h)
 	tmpFilename := filename + "-restic-temp-" + tempSuffix()
 	dirname := r.Dirname(h)
 
 	// create new file
-	f, err := r.c.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+	f, err := s.client.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
 
 	if r.IsNotExist(err) {
 		// error is caused by a missing directory, try to create it
-		mkdirErr := r.c.MkdirAll(r.Dirname(h))
+		mkdirErr := s.client.MkdirAll(r.Dirname(h))
 		if mkdirErr != nil {
 			debug.Log("error creating dir %v: %v", r.Dirname(h), mkdirErr)
 		} else {
 			// try again
-			f, err = r.c.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
+			f, err = s.client.OpenFile(tmpFilename, os.O_CREATE|os.O_EXCL|os.O_WRONLY)
 		}
 	}
 
@@ -330,7 +350,7 @@ func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader
 		}
 
 		// Try not to leave a partial file behind.
-		rmErr := r.c.Remove(f.Name())
+		rmErr := s.client.Remove(f.Name())
 		if rmErr != nil {
 			debug.Log("sftp: failed to remove broken file %v: %v",
 				f.Name(), rmErr)
@@ -341,7 +361,7 @@ func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader
 	wbytes, err := f.ReadFromWithConcurrency(rd, 0)
 	if err != nil {
 		_ = f.Close()
-		err = r.checkNoSpace(dirname, rd.Length(), err)
+		err = r.checkNoSpace(s, dirname, rd.Length(), err)
 		return errors.Wrapf(err, "Write %v", tmpFilename)
 	}
 
@@ -358,27 +378,27 @@ func (r *SFTP) Save(_ context.Context, h backend.Handle, rd backend.RewindReader
 
 	// Prefer POSIX atomic rename if available.
 	if r.posixRename {
-		err = r.c.PosixRename(tmpFilename, filename)
+		err = s.client.PosixRename(tmpFilename, filename)
 	} else {
-		err = r.c.Rename(tmpFilename, filename)
+		err = s.client.Rename(tmpFilename, filename)
 	}
 	return errors.Wrapf(err, "Rename %v", tmpFilename)
 }
 
 // checkNoSpace checks if err was likely caused by lack of available space
 // on the remote, and if so, makes it permanent.
-func (r *SFTP) checkNoSpace(dir string, size int64, origErr error) error {
+func (r *SFTP) checkNoSpace(s *session, dir string, size int64, origErr error) error {
 	// The SFTP protocol has a message for ENOSPC,
 	// but pkg/sftp doesn't export it and OpenSSH's sftp-server
 	// sends FX_FAILURE instead.
 
 	e, ok := origErr.(*sftp.StatusError)
-	_, hasExt := r.c.HasExtension("statvfs@openssh.com")
+	_, hasExt := s.client.HasExtension("statvfs@openssh.com")
 	if !ok || e.FxCode() != sftp.ErrSSHFxFailure || !hasExt {
 		return origErr
 	}
 
-	fsinfo, err := r.c.StatVFS(dir)
+	fsinfo, err := s.client.StatVFS(dir)
 	if err != nil {
 		debug.Log("sftp: StatVFS returned %v", err)
 		return origErr
@@ -393,10 +413,6 @@ func (r *SFTP) checkNoSpace(dir string, size int64, origErr error) error {
 // Load runs fn with a reader that yields the contents of the file at h at the
 // given offset.
 func (r *SFTP) Load(ctx context.Context, h backend.Handle, length int, offset int64, fn func(rd io.Reader) error) error {
-	if err := r.clientError(); err != nil {
-		return err
-	}
-
 	return util.DefaultLoad(ctx, h, length, offset, r.openReader, func(rd io.Reader) error {
 		if length == 0 || !feature.Flag.Enabled(feature.BackendErrorRedesign) {
 			return fn(rd)
@@ -417,9 +433,15 @@ func (r *SFTP) Load(ctx context.Context, h backend.Handle, length int, offset in
 	})
 }
 
-func (r *SFTP) openReader(_ context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
-	f, err := r.c.Open(r.Filename(h))
+func (r *SFTP) openReader(ctx context.Context, h backend.Handle, length int, offset int64) (io.ReadCloser, error) {
+	s, err := r.pool.get(ctx)
 	if err != nil {
+		return nil, err
+	}
+
+	f, err := s.client.Open(r.Filename(h))
+	if err != nil {
+		r.pool.put(s)
 		return nil, errors.Wrapf(err, "Open %v", r.Filename(h))
 	}
 
@@ -427,26 +449,46 @@ func (r *SFTP) openReader(_ context.Context, h backend.Handle, length int, offse
 		_, err = f.Seek(offset, 0)
 		if err != nil {
 			_ = f.Close()
+			r.pool.put(s)
 			return nil, errors.Wrapf(err, "Seek %v", r.Filename(h))
 		}
 	}
 
+	// pooledFile returns the session to the pool once the file is closed.
+	pf := &pooledFile{sftpFile: f, pool: r.pool, session: s}
+
 	if length > 0 {
 		// unlimited reads usually use io.Copy which needs WriteTo support at the underlying reader
 		// limited reads are usually combined with io.ReadFull which reads all required bytes into a buffer in one go
-		return util.LimitReadCloser(f, int64(length)), nil
+		return util.LimitReadCloser(pf, int64(length)), nil
 	}
 
-	return f, nil
+	return pf, nil
+}
+
+// pooledFile wraps a remote file opened on a checked-out session and returns
+// that session to the pool once the file is closed.
+type pooledFile struct {
+	sftpFile
+	pool    *sessionPool
+	session *session
+}
+
+func (f *pooledFile) Close() error {
+	err := f.sftpFile.Close()
+	f.pool.put(f.session)
+	return err
 }
 
 // Stat returns information about a blob.
-func (r *SFTP) Stat(_ context.Context, h backend.Handle) (backend.FileInfo, error) {
-	if err := r.clientError(); err != nil {
+func (r *SFTP) Stat(ctx context.Context, h backend.Handle) (backend.FileInfo, error) {
+	s, err := r.pool.get(ctx)
+	if err != nil {
 		return backend.FileInfo{}, err
 	}
+	defer r.pool.put(s)
 
-	fi, err := r.c.Lstat(r.Filename(h))
+	fi, err := s.client.Lstat(r.Filename(h))
 	if err != nil {
 		return backend.FileInfo{}, errors.Wrapf(err, "Lstat %v", r.Filename(h))
 	}
@@ -455,23 +497,27 @@ func (r *SFTP) Stat(_ context.Context, h backend.Handle) (backend.FileInfo, erro
 }
 
 // Remove removes the content stored at name.
-func (r *SFTP) Remove(_ context.Context, h backend.Handle) error {
-	if err := r.clientError(); err != nil {
+func (r *SFTP) Remove(ctx context.Context, h backend.Handle) error {
+	s, err := r.pool.get(ctx)
+	if err != nil {
 		return err
 	}
+	defer r.pool.put(s)
 
-	return errors.Wrapf(r.c.Remove(r.Filename(h)), "Remove %v", r.Filename(h))
+	return errors.Wrapf(s.client.Remove(r.Filename(h)), "Remove %v", r.Filename(h))
 }
 
 // List runs fn for each file in the backend which has the type t. When an
 // error occurs (or fn returns an error), List stops and returns it.
 func (r *SFTP) List(ctx context.Context, t backend.FileType, fn func(backend.FileInfo) error) error {
-	if err := r.clientError(); err != nil {
+	s, err := r.pool.get(ctx)
+	if err != nil {
 		return err
 	}
+	defer r.pool.put(s)
 
 	basedir, subdirs := r.Basedir(t)
-	walker := r.c.Walk(basedir)
+	walker := s.client.Walk(basedir)
 	for {
 		ok := walker.Step()
 		if !ok {
@@ -526,33 +572,18 @@ func (r *SFTP) List(ctx context.Context, t backend.FileType, fn func(backend.Fil
 
 var closeTimeout = 2 * time.Second
 
-// Close closes the sftp connection and terminates the underlying command.
+// Close closes all sessions in the pool and terminates the underlying
+// connections.
 func (r *SFTP) Close() error {
 	if r == nil {
 		return nil
 	}
 
-	err := errors.Wrap(r.c.Close(), "Close")
-	debug.Log("Close returned error %v", err)
-
-	// wait for closeTimeout before killing the process
-	select {
-	case err := <-r.result:
-		return err
-	case <-time.After(closeTimeout):
-	}
-
-	if err := r.cmd.Process.Kill(); err != nil {
-		return err
-	}
-
-	// get the error, but ignore it
-	<-r.result
-	return nil
+	return r.pool.Close()
 }
 
-func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
-	entries, err := r.c.ReadDir(name)
+func (r *SFTP) deleteRecursive(ctx context.Context, s *session, name string) error {
+	entries, err := s.client.ReadDir(name)
 	if err != nil {
 		return errors.Wrapf(err, "ReadDir %v", name)
 	}
@@ -564,12 +595,12 @@ func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
 
 		itemName := path.Join(name, fi.Name())
 		if fi.IsDir() {
-			err := r.deleteRecursive(ctx, itemName)
+			err := r.deleteRecursive(ctx, s, itemName)
 			if err != nil {
 				return err
 			}
 
-			err = r.c.RemoveDirectory(itemName)
+			err = s.client.RemoveDirectory(itemName)
 			if err != nil {
 				return errors.Wrapf(err, "RemoveDirectory %v", itemName)
 			}
@@ -577,7 +608,7 @@ func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
 			continue
 		}
 
-		err := r.c.Remove(itemName)
+		err := s.client.Remove(itemName)
 		if err != nil {
 			return errors.Wrapf(err, "Remove %v", itemName)
 		}
@@ -588,11 +619,127 @@ func (r *SFTP) deleteRecursive(ctx context.Context, name string) error {
 
 // Delete removes all data in the backend.
 func (r *SFTP) Delete(ctx context.Context) error {
-	return r.deleteRecursive(ctx, r.p)
+	s, err := r.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.pool.put(s)
+
+	return r.deleteRecursive(ctx, s, r.p)
+}
+
+// warmupConcurrency bounds how many files are opened for warmup at once, so
+// that a large restore doesn't exhaust the session pool or the remote
+// server's file descriptor limit.
+const warmupConcurrency = 8
+
+// warmupPrefetchSize is the number of bytes read from the start of a file
+// to trigger prefetch/readahead on the remote side.
+const warmupPrefetchSize = 128 * 1024
+
+// warmupResult tracks the outcome of a single handle's warmup, so that
+// WarmupWait can wait for exactly the handles it was given rather than
+// whatever the most recently started Warmup batch happens to be.
+type warmupResult struct {
+	done chan struct{}
+	err  error
+}
+
+// Warmup triggers the remote OS page cache / HSM stage-in for the given
+// handles, according to Config.Warmup ("none", "touch" or "prefetch"), and
+// returns once every handle's warmup has been started, without waiting for
+// them to finish. At most warmupConcurrency warmups run at once, so with
+// more handles than that Warmup blocks until earlier ones have completed
+// and freed a slot. Callers may start another Warmup batch before calling
+// WarmupWait on this one; each batch is tracked independently by handle.
+// Use WarmupWait to wait for completion.
+func (r *SFTP) Warmup(ctx context.Context, h []backend.Handle) ([]backend.Handle, error) {
+	if r.Config.Warmup == "" || r.Config.Warmup == "none" {
+		return []backend.Handle{}, nil
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(warmupConcurrency)
+
+	results := make(map[backend.Handle]*warmupResult, len(h))
+	for _, handle := range h {
+		handle := handle
+		res := &warmupResult{done: make(chan struct{})}
+		results[handle] = res
+		g.Go(func() error {
+			err := r.warmupOne(ctx, handle)
+			res.err = err
+			close(res.done)
+			return err
+		})
+	}
+
+	r.warmupMu.Lock()
+	if r.warmups == nil {
+		r.warmups = make(map[backend.Handle]*warmupResult, len(results))
+	}
+	for handle, res := range results {
+		r.warmups[handle] = res
+	}
+	r.warmupMu.Unlock()
+
+	return h, nil
+}
+
+// warmupOne opens handle, optionally reads the first warmupPrefetchSize
+// bytes to trigger prefetch, and closes it again without reading the rest
+// of the file.
+func (r *SFTP) warmupOne(ctx context.Context, h backend.Handle) error {
+	s, err := r.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	defer r.pool.put(s)
+
+	f, err := s.client.Open(r.Filename(h))
+	if err != nil {
+		return errors.Wrapf(err, "Open %v", r.Filename(h))
+	}
+	defer func() { _ = f.Close() }()
+
+	if r.Config.Warmup != "prefetch" {
+		return nil
+	}
+
+	buf := make([]byte, warmupPrefetchSize)
+	if _, err := f.Read(buf); err != nil && err != io.EOF {
+		return errors.Wrapf(err, "warmup read %v", r.Filename(h))
+	}
+
+	return nil
 }
 
-// Warmup not implemented
-func (r *SFTP) Warmup(_ context.Context, _ []backend.Handle) ([]backend.Handle, error) {
-	return []backend.Handle{}, nil
+// WarmupWait blocks until the prefetches started for h by Warmup have
+// finished, or ctx is cancelled, and returns the first error among them.
+// Handles that were never passed to Warmup (or have already been waited
+// for) are ignored.
+func (r *SFTP) WarmupWait(ctx context.Context, h []backend.Handle) error {
+	r.warmupMu.Lock()
+	results := make([]*warmupResult, 0, len(h))
+	for _, handle := range h {
+		if res, ok := r.warmups[handle]; ok {
+			results = append(results, res)
+			delete(r.warmups, handle)
+		}
+	}
+	r.warmupMu.Unlock()
+
+	var firstErr error
+	for _, res := range results {
+		select {
+		case <-res.done:
+			if res.err != nil && firstErr == nil {
+				firstErr = res.err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return firstErr
 }
-func (r *SFTP) WarmupWait(_ context.Context, _ []backend.Handle) error { return nil }
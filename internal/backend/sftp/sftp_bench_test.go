@@ -0,0 +1,104 @@
+package sftp
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"path"
+	"sync"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/layout"
+
+	"github.com/pkg/sftp"
+)
+
+// pipeRWC glues the read and write ends of two io.Pipes into a single
+// io.ReadWriteCloser, as required by sftp.NewServer/NewClientPipe.
+type pipeRWC struct {
+	io.Reader
+	io.Writer
+}
+
+func (pipeRWC) Close() error { return nil }
+
+// newLoopbackSession starts an in-process sftp server rooted at dir and
+// returns a session talking to it over local pipes, without spawning ssh or
+// an external sftp-server.
+func newLoopbackSession(tb testing.TB, dir string) *session {
+	tb.Helper()
+
+	clientRd, serverWr := io.Pipe()
+	serverRd, clientWr := io.Pipe()
+
+	server, err := sftp.NewServer(pipeRWC{serverRd, serverWr}, sftp.WithServerWorkingDirectory(dir))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	tb.Cleanup(func() { _ = server.Close() })
+
+	client, err := sftp.NewClientPipe(clientRd, clientWr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { _ = client.Close() })
+
+	return &session{client: sftpClientFS{client}, result: make(chan error, 1)}
+}
+
+// BenchmarkSaveParallel measures the aggregate throughput of concurrent Save
+// calls against a pool of loopback sftp sessions, for varying pool sizes, to
+// show the effect of Config.Connections on parallel Save throughput.
+func BenchmarkSaveParallel(b *testing.B) {
+	const blobSize = 4 << 20 // 4 MiB
+
+	data := make([]byte, blobSize)
+	if _, err := rand.Read(data); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, connections := range []uint{1, 2, 4, 8} {
+		connections := connections
+		b.Run(fmt.Sprintf("connections=%d", connections), func(b *testing.B) {
+			dir := b.TempDir()
+
+			sessions := make(chan *session, connections)
+			for i := uint(0); i < connections; i++ {
+				sessions <- newLoopbackSession(b, dir)
+			}
+			pool := &sessionPool{cfg: Config{Connections: connections}, sessions: sessions}
+
+			r := &SFTP{
+				pool:   pool,
+				p:      dir,
+				Config: Config{Connections: connections},
+				Layout: layout.NewDefaultLayout(dir, path.Join),
+			}
+
+			// each iteration saves one blob per connection
+			b.SetBytes(blobSize * int64(connections))
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				var wg sync.WaitGroup
+				for j := uint(0); j < connections; j++ {
+					wg.Add(1)
+					go func(n int) {
+						defer wg.Done()
+						h := backend.Handle{Type: backend.PackFile, Name: fmt.Sprintf("bench-%d-%d-%d", i, n, connections)}
+						rd := backend.NewByteReader(data, nil)
+						if err := r.Save(context.Background(), h, rd); err != nil {
+							b.Error(err)
+						}
+					}(int(j))
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,346 @@
+package sftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"testing"
+
+	"github.com/restic/restic/internal/backend"
+	"github.com/restic/restic/internal/backend/layout"
+	"github.com/restic/restic/internal/backend/sftp/memfs"
+	"github.com/restic/restic/internal/backend/util"
+	"github.com/restic/restic/internal/errors"
+	"github.com/restic/restic/internal/feature"
+
+	"github.com/cenkalti/backoff/v4"
+	"github.com/pkg/sftp"
+)
+
+// memfsAdapter adapts a *memfs.FS to the sftpFS interface, the same way
+// sftpClientFS adapts a *sftp.Client: memfs.FS's Open/OpenFile/Walk methods
+// return their own concrete types, not the narrower sftpFile/fsWalker
+// interfaces sftpFS requires, so they need narrowing wrappers here.
+type memfsAdapter struct {
+	*memfs.FS
+}
+
+func (m memfsAdapter) Open(path string) (sftpFile, error) {
+	return m.FS.Open(path)
+}
+
+func (m memfsAdapter) OpenFile(path string, flags int) (sftpFile, error) {
+	return m.FS.OpenFile(path, flags)
+}
+
+func (m memfsAdapter) Walk(root string) fsWalker {
+	return m.FS.Walk(root)
+}
+
+var _ sftpFS = memfsAdapter{}
+
+// newTestSFTP returns an *SFTP backed by a single in-memory session using
+// fs, with its data/ref subdirectories already created, ready for Save/Load.
+func newTestSFTP(t *testing.T, fs *memfs.FS) *SFTP {
+	t.Helper()
+
+	const dir = "/repo"
+	cfg := NewConfig()
+	cfg.Path = dir
+	cfg.Connections = 1
+
+	s := &session{client: memfsAdapter{fs}, result: make(chan error, 1)}
+	pool := &sessionPool{cfg: cfg, sessions: make(chan *session, 1)}
+	pool.sessions <- s
+
+	r := &SFTP{pool: pool, p: dir, Config: cfg, Layout: layout.NewDefaultLayout(dir, path.Join), Modes: util.DefaultModes}
+
+	if err := r.mkdirAllDataSubdirs(context.Background(), cfg.Connections); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func testHandle(name string) backend.Handle {
+	return backend.Handle{Type: backend.PackFile, Name: name}
+}
+
+func loadAll(t *testing.T, r *SFTP, h backend.Handle) []byte {
+	t.Helper()
+
+	var data []byte
+	err := r.Load(context.Background(), h, 0, 0, func(rd io.Reader) error {
+		var readErr error
+		data, readErr = io.ReadAll(rd)
+		return readErr
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestSaveLoad covers the tempfile+rename atomicity path: Save writes to a
+// "-restic-temp-" sibling file and only the final name is ever visible to
+// Load.
+func TestSaveLoad(t *testing.T) {
+	fs := memfs.New()
+	r := newTestSFTP(t, fs)
+
+	h := testHandle("saveload")
+	want := []byte("the quick brown fox jumps over the lazy dog")
+
+	if err := r.Save(context.Background(), h, backend.NewByteReader(want, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loadAll(t, r, h); string(got) != string(want) {
+		t.Fatalf("Load returned %q, want %q", got, want)
+	}
+
+	entries, err := fs.ReadDir(r.Dirname(h))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != path.Base(r.Filename(h)) {
+		t.Fatalf("directory contains leftover temp files: %v", entries)
+	}
+}
+
+// TestSavePosixRename covers Save with PosixRename both enabled and disabled:
+// either way, the final file ends up at the plain name.
+func TestSavePosixRename(t *testing.T) {
+	for _, posixRename := range []bool{true, false} {
+		posixRename := posixRename
+		t.Run(fmt.Sprintf("posixRename=%v", posixRename), func(t *testing.T) {
+			fs := memfs.New()
+			fs.PosixRenameSupported = posixRename
+			r := newTestSFTP(t, fs)
+			r.posixRename = posixRename
+
+			h := testHandle("data")
+			want := []byte("hello, world")
+			if err := r.Save(context.Background(), h, backend.NewByteReader(want, nil)); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := loadAll(t, r, h); string(got) != string(want) {
+				t.Fatalf("Load returned %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+// TestLoadTooShort covers errTooShort: requesting more bytes than a file
+// contains must fail with errTooShort once the length-checked read path is
+// enabled.
+func TestLoadTooShort(t *testing.T) {
+	fs := memfs.New()
+	r := newTestSFTP(t, fs)
+
+	h := testHandle("short")
+	if err := r.Save(context.Background(), h, backend.NewByteReader([]byte("short"), nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	err := r.Load(context.Background(), h, len("short")+10, 0, func(rd io.Reader) error {
+		_, err := io.ReadAll(rd)
+		return err
+	})
+	if !errors.Is(err, errTooShort) && !feature.Flag.Enabled(feature.BackendErrorRedesign) {
+		t.Skip("errTooShort is only surfaced with the BackendErrorRedesign feature flag enabled")
+	}
+	if !errors.Is(err, errTooShort) {
+		t.Fatalf("expected errTooShort reading past the end of a short file, got %v", err)
+	}
+}
+
+// TestCheckNoSpace covers checkNoSpace using memfs's fake StatVFS: a write
+// failure combined with an almost-full filesystem becomes a permanent error.
+func TestCheckNoSpace(t *testing.T) {
+	fs := memfs.New()
+	fs.StatVFSSupported = true
+	fs.StatVFSResult = &sftp.StatVFS{Bsize: 4096, Frsize: 4096, Blocks: 1, Bavail: 0, Favail: 0}
+	r := newTestSFTP(t, fs)
+
+	s, err := r.pool.get(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.pool.put(s)
+
+	origErr := &sftp.StatusError{Code: uint32(sftp.ErrSSHFxFailure)}
+	err = r.checkNoSpace(s, r.Dirname(testHandle("x")), 1<<20, origErr)
+
+	var perm *backoff.PermanentError
+	if !errors.As(err, &perm) {
+		t.Fatalf("checkNoSpace did not turn a no-space StatusError into a permanent error: %v", err)
+	}
+}
+
+// TestSaveMkdirAllOnNotExist covers the MkdirAll-on-ENOENT retry path in
+// Save: saving into a directory that doesn't exist yet (no mkdirAllDataSubdirs
+// has run) must create it on the fly and still succeed.
+func TestSaveMkdirAllOnNotExist(t *testing.T) {
+	const dir = "/repo"
+	cfg := NewConfig()
+	cfg.Path = dir
+	cfg.Connections = 1
+
+	fs := memfs.New()
+	if err := fs.MkdirAll(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := &sessionPool{cfg: cfg, sessions: make(chan *session, 1)}
+	pool.sessions <- &session{client: memfsAdapter{fs}, result: make(chan error, 1)}
+
+	r := &SFTP{pool: pool, p: dir, Config: cfg, Layout: layout.NewDefaultLayout(dir, path.Join), Modes: util.DefaultModes}
+
+	h := testHandle("ab" + tempSuffix())
+	want := []byte("payload")
+
+	if err := r.Save(context.Background(), h, backend.NewByteReader(want, nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := loadAll(t, r, h); string(got) != string(want) {
+		t.Fatalf("Load returned %q, want %q", got, want)
+	}
+}
+
+// TestMkdirAllDataSubdirsConcurrent covers mkdirAllDataSubdirs being run
+// with concurrency > 1 against a shared in-memory filesystem: overlapping
+// MkdirAll calls for directories with common parents must not fail or race.
+func TestMkdirAllDataSubdirsConcurrent(t *testing.T) {
+	fs := memfs.New()
+	const dir = "/repo"
+	cfg := NewConfig()
+	cfg.Path = dir
+	cfg.Connections = 8
+
+	pool := &sessionPool{cfg: cfg, sessions: make(chan *session, cfg.Connections)}
+	for i := uint(0); i < cfg.Connections; i++ {
+		pool.sessions <- &session{client: memfsAdapter{fs}, result: make(chan error, 1)}
+	}
+
+	r := &SFTP{pool: pool, p: dir, Config: cfg, Layout: layout.NewDefaultLayout(dir, path.Join), Modes: util.DefaultModes}
+
+	if err := r.mkdirAllDataSubdirs(context.Background(), cfg.Connections); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, d := range r.Paths() {
+		if _, err := fs.Stat(d); err != nil {
+			t.Fatalf("directory %v was not created: %v", d, err)
+		}
+	}
+}
+
+// TestWarmupModes covers Warmup/WarmupWait for both the "touch" and
+// "prefetch" strategies: warming up a handle that exists must succeed in
+// either mode, and warming up one that doesn't must surface an error.
+func TestWarmupModes(t *testing.T) {
+	for _, warmup := range []string{"touch", "prefetch"} {
+		warmup := warmup
+		t.Run(warmup, func(t *testing.T) {
+			fs := memfs.New()
+			r := newTestSFTP(t, fs)
+			r.Config.Warmup = warmup
+
+			h := testHandle("exists")
+			if err := r.Save(context.Background(), h, backend.NewByteReader([]byte("warm me up"), nil)); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := r.Warmup(context.Background(), []backend.Handle{h}); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.WarmupWait(context.Background(), []backend.Handle{h}); err != nil {
+				t.Fatalf("WarmupWait for an existing handle returned an error: %v", err)
+			}
+
+			missing := testHandle("missing")
+			if _, err := r.Warmup(context.Background(), []backend.Handle{missing}); err != nil {
+				t.Fatal(err)
+			}
+			if err := r.WarmupWait(context.Background(), []backend.Handle{missing}); err == nil {
+				t.Fatal("WarmupWait for a missing handle should have returned an error")
+			}
+		})
+	}
+}
+
+// TestWarmupNone covers Config.Warmup == "none" (the default): Warmup does
+// nothing and WarmupWait has no batch to wait for, so it must return
+// immediately without error.
+func TestWarmupNone(t *testing.T) {
+	fs := memfs.New()
+	r := newTestSFTP(t, fs)
+
+	h := testHandle("irrelevant")
+	handles, err := r.Warmup(context.Background(), []backend.Handle{h})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(handles) != 0 {
+		t.Fatalf("Warmup with Config.Warmup=none returned %v, want no handles", handles)
+	}
+
+	if err := r.WarmupWait(context.Background(), []backend.Handle{h}); err != nil {
+		t.Fatalf("WarmupWait returned %v, want nil", err)
+	}
+}
+
+// TestWarmupBatchIsolation covers the bug fixed in a prior commit: issuing
+// a second Warmup batch before WarmupWait is called on the first must not
+// make WarmupWait for the first batch observe the second batch's outcome.
+func TestWarmupBatchIsolation(t *testing.T) {
+	fs := memfs.New()
+	r := newTestSFTP(t, fs)
+	r.Config.Warmup = "touch"
+
+	ok := testHandle("ok")
+	if err := r.Save(context.Background(), ok, backend.NewByteReader([]byte("x"), nil)); err != nil {
+		t.Fatal(err)
+	}
+	missing := testHandle("missing")
+
+	// Start warming up ok, then - before waiting for it - start a second
+	// batch for a handle that will fail to warm up.
+	if _, err := r.Warmup(context.Background(), []backend.Handle{ok}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Warmup(context.Background(), []backend.Handle{missing}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.WarmupWait(context.Background(), []backend.Handle{ok}); err != nil {
+		t.Fatalf("WarmupWait for the first (successful) batch returned %v, want nil - "+
+			"it must not have observed the second batch's failure", err)
+	}
+	if err := r.WarmupWait(context.Background(), []backend.Handle{missing}); err == nil {
+		t.Fatal("WarmupWait for the second (failing) batch should have returned an error")
+	}
+}
+
+// TestWarmupWaitContextCancelled covers WarmupWait returning ctx.Err()
+// for a batch that hasn't finished yet when ctx is cancelled.
+func TestWarmupWaitContextCancelled(t *testing.T) {
+	fs := memfs.New()
+	r := newTestSFTP(t, fs)
+
+	h := testHandle("pending")
+	r.warmupMu.Lock()
+	r.warmups = map[backend.Handle]*warmupResult{h: {done: make(chan struct{})}}
+	r.warmupMu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.WarmupWait(ctx, []backend.Handle{h}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("WarmupWait with a cancelled context and pending work returned %v, want context.Canceled", err)
+	}
+}